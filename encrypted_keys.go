@@ -0,0 +1,213 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// LazyScryptIdentity is an age.Identity that only prompts for a passphrase
+// the first time it's asked to unwrap a scrypt stanza, caching the
+// resulting identity for any further scrypt recipients in the same file.
+type LazyScryptIdentity struct {
+	Passphrase func() (string, error)
+
+	identity *age.ScryptIdentity
+}
+
+func (i *LazyScryptIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	hasScrypt := false
+	for _, s := range stanzas {
+		if s.Type == "scrypt" {
+			hasScrypt = true
+		}
+	}
+	if !hasScrypt {
+		return nil, age.ErrIncorrectIdentity
+	}
+	if i.identity == nil {
+		pass, err := i.Passphrase()
+		if err != nil {
+			return nil, fmt.Errorf("could not read passphrase: %v", err)
+		}
+		id, err := age.NewScryptIdentity(pass)
+		if err != nil {
+			return nil, err
+		}
+		i.identity = id
+	}
+	return i.identity.Unwrap(stanzas)
+}
+
+// EncryptedIdentity wraps an identity file that's itself a passphrase
+// encrypted age file, as produced by "age -p -o key.txt.age key.txt", and
+// decrypts it lazily using Passphrase before using the identities inside.
+type EncryptedIdentity struct {
+	Contents       []byte
+	Passphrase     func() (string, error)
+	NoMatchWarning func(format string, v ...interface{})
+}
+
+func (i *EncryptedIdentity) identities() ([]age.Identity, error) {
+	d, err := age.Decrypt(bytes.NewReader(i.Contents), &LazyScryptIdentity{Passphrase: i.Passphrase})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt identity file: %v", err)
+	}
+	contents, err := io.ReadAll(d)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read decrypted identity file: %v", err)
+	}
+	return parseIdentities(bytes.NewReader(contents))
+}
+
+func (i *EncryptedIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	ids, err := i.identities()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		fileKey, err := id.Unwrap(stanzas)
+		if errors.Is(err, age.ErrIncorrectIdentity) {
+			if i.NoMatchWarning != nil {
+				i.NoMatchWarning("identity in encrypted identity file didn't match file")
+			}
+			continue
+		}
+		return fileKey, err
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+// Recipients returns the recipients corresponding to the identities
+// protected by this encrypted identity file, for symmetric "-i" encryption.
+func (i *EncryptedIdentity) Recipients() ([]age.Recipient, error) {
+	ids, err := i.identities()
+	if err != nil {
+		return nil, err
+	}
+	return identitiesToRecipients(ids)
+}
+
+// parseIdentities parses the lines of a decrypted identity file into
+// age.Identity values, recognizing native X25519 secret keys and plugin
+// identities. Empty lines and lines starting with "#" are comments.
+func parseIdentities(r io.Reader) ([]age.Identity, error) {
+	var ids []age.Identity
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "AGE-PLUGIN-"):
+			id, err := parsePluginIdentity(line)
+			if err != nil {
+				return nil, fmt.Errorf("malformed plugin identity: %v", err)
+			}
+			ids = append(ids, id)
+		default:
+			id, err := age.ParseX25519Identity(line)
+			if err != nil {
+				return nil, fmt.Errorf("malformed secret key: %v", err)
+			}
+			ids = append(ids, id)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// parseIdentitiesFile reads the identities in an "-i" identity file, which
+// is either a plain list of identities as parsed by parseIdentities, or,
+// if it doesn't parse as one, a passphrase encrypted identity file as
+// produced by "age -p -o key.txt.age key.txt". getPassphrase supplies the
+// passphrase for the latter case.
+func parseIdentitiesFile(name string, getPassphrase func() (string, error)) ([]age.Identity, error) {
+	f, err := openNamedInput(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %v", name, err)
+	}
+
+	if ids, err := parseIdentities(bytes.NewReader(data)); err == nil && len(ids) > 0 {
+		return ids, nil
+	}
+	return []age.Identity{&EncryptedIdentity{
+		Contents:       data,
+		Passphrase:     getPassphrase,
+		NoMatchWarning: warningf,
+	}}, nil
+}
+
+// openNamedInput opens name for reading, treating "-" as standard input.
+func openNamedInput(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		stdinInUse = true
+		return io.NopCloser(os.Stdin), nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file %q: %v", name, err)
+	}
+	return f, nil
+}
+
+// identityPassphrase returns the function used to obtain the passphrase
+// for a scrypt-protected identity file. It prefers, in order, an explicit
+// --identity-passphrase-command, the AGE_IDENTITY_PASSPHRASE_FILE
+// environment variable, and finally the interactive TTY prompt. In batch
+// mode the TTY prompt is replaced with an immediate error.
+func identityPassphrase(batch bool, passphraseCommand string) func() (string, error) {
+	switch {
+	case passphraseCommand != "":
+		return func() (string, error) {
+			return runPassphraseCommand(passphraseCommand)
+		}
+	case os.Getenv("AGE_IDENTITY_PASSPHRASE_FILE") != "":
+		path := os.Getenv("AGE_IDENTITY_PASSPHRASE_FILE")
+		return func() (string, error) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return "", fmt.Errorf("failed to read AGE_IDENTITY_PASSPHRASE_FILE: %v", err)
+			}
+			return strings.TrimRight(string(data), "\r\n"), nil
+		}
+	case batch:
+		return func() (string, error) {
+			return "", errors.New("passphrase required but --batch was set and no " +
+				"--identity-passphrase-command or AGE_IDENTITY_PASSPHRASE_FILE was provided")
+		}
+	default:
+		return passphrasePrompt
+	}
+}
+
+func runPassphraseCommand(command string) (string, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("--identity-passphrase-command failed: %v", err)
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// groupRecipient aggregates the recipients that make up a named group (or
+// an alias, which is simply a group of one), so that a single token in a
+// recipients file can expand to every member of a team. Wrap collects the
+// stanzas of every member, so any of them can decrypt.
+type groupRecipient struct {
+	name    string
+	members []age.Recipient
+}
+
+func (g *groupRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	var stanzas []*age.Stanza
+	for i, r := range g.members {
+		s, err := r.Wrap(fileKey)
+		if err != nil {
+			return nil, fmt.Errorf("group %q, member %d: %w", g.name, i+1, err)
+		}
+		stanzas = append(stanzas, s...)
+	}
+	return stanzas, nil
+}
+
+// recipientGroups maps group names, as defined by "@group NAME" blocks, to
+// their member recipient tokens. There is no separate alias syntax: an
+// alias is a "@group" block with a single member.
+type recipientGroups map[string][]string
+
+// parseRecipientsFile reads a recipients file, expanding "@group NAME" /
+// "@include PATH" directives and group references, and returns the
+// flattened list of recipients. Empty lines and lines starting with "#"
+// are ignored as comments, same as a plain recipient file.
+func parseRecipientsFile(name string) ([]age.Recipient, error) {
+	f, in := os.Stdin, "-"
+	if name != "-" {
+		var err error
+		f, err = os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = name
+	}
+
+	groups := make(recipientGroups)
+	var order []string
+	if err := loadGroups(f, filepath.Dir(in), groups, &order, make(map[string]bool)); err != nil {
+		return nil, err
+	}
+
+	var recipients []age.Recipient
+	for _, tok := range order {
+		rs, err := expandToken(tok, groups, make(map[string]bool))
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand %q: %w", tok, err)
+		}
+		recipients = append(recipients, rs...)
+	}
+	return recipients, nil
+}
+
+// loadGroups scans a recipients file (and anything it "@include"s),
+// recording top-level recipient tokens (in order) and any "@group NAME"
+// blocks it defines, so that later references to NAME can be expanded.
+func loadGroups(f *os.File, baseDir string, groups recipientGroups, order *[]string, includeStack map[string]bool) error {
+	scanner := bufio.NewScanner(f)
+	var currentGroup string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "@group "):
+			currentGroup = strings.TrimSpace(strings.TrimPrefix(line, "@group "))
+			if currentGroup == "" {
+				return fmt.Errorf("empty @group name")
+			}
+		case strings.HasPrefix(line, "@include "):
+			path := strings.TrimSpace(strings.TrimPrefix(line, "@include "))
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(baseDir, path)
+			}
+			if includeStack[path] {
+				return fmt.Errorf("@include cycle detected at %q", path)
+			}
+			includeStack[path] = true
+			inc, err := os.Open(path)
+			if err != nil {
+				return fmt.Errorf("failed to open @include %q: %w", path, err)
+			}
+			err = loadGroups(inc, filepath.Dir(path), groups, order, includeStack)
+			inc.Close()
+			delete(includeStack, path)
+			if err != nil {
+				return err
+			}
+		case currentGroup != "":
+			groups[currentGroup] = append(groups[currentGroup], line)
+		default:
+			*order = append(*order, line)
+		}
+	}
+	return scanner.Err()
+}
+
+// expandToken resolves a single recipient token, which may itself be the
+// name of a group, recursively flattening it to concrete recipients while
+// detecting reference cycles between groups.
+func expandToken(tok string, groups recipientGroups, seen map[string]bool) ([]age.Recipient, error) {
+	if members, ok := groups[tok]; ok {
+		if seen[tok] {
+			return nil, fmt.Errorf("group %q is part of a reference cycle", tok)
+		}
+		// seen only needs to track the groups on the current recursion
+		// path, not every group ever visited: a diamond-shaped reference
+		// (two groups both including a common base group) isn't a cycle,
+		// so tok must come back out once its own members are expanded.
+		seen[tok] = true
+		defer delete(seen, tok)
+		var recipients []age.Recipient
+		for _, m := range members {
+			rs, err := expandToken(m, groups, seen)
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, rs...)
+		}
+		if len(recipients) == 0 {
+			return nil, fmt.Errorf("group %q has no members", tok)
+		}
+		return []age.Recipient{&groupRecipient{name: tok, members: recipients}}, nil
+	}
+
+	if r, err := parsePluginRecipient(tok); err != errNotPlugin {
+		if err != nil {
+			return nil, err
+		}
+		return []age.Recipient{r}, nil
+	}
+	r, err := parseRecipient(tok)
+	if err != nil {
+		return nil, err
+	}
+	return []age.Recipient{r}, nil
+}
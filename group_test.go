@@ -0,0 +1,36 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import "testing"
+
+// TestExpandTokenDiamond checks that a group referenced by two sibling
+// groups (a diamond, not a cycle) expands successfully instead of
+// tripping the reference-cycle guard.
+func TestExpandTokenDiamond(t *testing.T) {
+	groups := recipientGroups{
+		"base":     {"age1plugin1aaaa"},
+		"team_eng": {"base"},
+		"team_ops": {"base"},
+		"team_all": {"team_eng", "team_ops"},
+	}
+	if _, err := expandToken("team_all", groups, make(map[string]bool)); err != nil {
+		t.Fatalf("expandToken rejected a non-cyclic diamond reference: %v", err)
+	}
+}
+
+// TestExpandTokenCycle checks that an actual reference cycle is still
+// rejected.
+func TestExpandTokenCycle(t *testing.T) {
+	groups := recipientGroups{
+		"a": {"b"},
+		"b": {"a"},
+	}
+	if _, err := expandToken("a", groups, make(map[string]bool)); err == nil {
+		t.Fatal("expandToken accepted a genuine reference cycle")
+	}
+}
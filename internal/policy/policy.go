@@ -0,0 +1,82 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+// Package policy implements a declarative, SOPS-style creation_rules file
+// that maps file paths to age recipients, so a user encrypting many files
+// doesn't have to repeat -r on every invocation.
+package policy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule is a single creation rule: if PathRegex matches the input path, its
+// recipients are used to encrypt it.
+type Rule struct {
+	PathRegex       string   `yaml:"path_regex"`
+	Recipients      []string `yaml:"age"`
+	RecipientsFiles []string `yaml:"age_recipients_files"`
+	Passphrase      bool     `yaml:"passphrase"`
+	Armor           *bool    `yaml:"armor"`
+}
+
+// Config is a parsed creation rules file. Rules are matched in order and
+// the first match wins, mirroring SOPS's creation_rules semantics.
+type Config struct {
+	CreationRules []Rule `yaml:"creation_rules"`
+}
+
+// Load reads and parses a YAML creation rules file at path.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %w", path, err)
+	}
+	var c Config
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %w", path, err)
+	}
+	for i, r := range c.CreationRules {
+		if _, err := regexp.Compile(r.PathRegex); err != nil {
+			return nil, fmt.Errorf("rule %d: invalid path_regex %q: %w", i+1, r.PathRegex, err)
+		}
+	}
+	return &c, nil
+}
+
+// Match returns the first rule whose path_regex matches path (or
+// pathOverride, if non-empty, in its place), and the recipient strings
+// with any $VAR / ${VAR} references expanded from the environment.
+func (c *Config) Match(path, pathOverride string) (*Rule, []string, error) {
+	candidate := path
+	if pathOverride != "" {
+		candidate = pathOverride
+	}
+	candidate = filepath.ToSlash(candidate)
+
+	for i, r := range c.CreationRules {
+		re, err := regexp.Compile(r.PathRegex)
+		if err != nil {
+			return nil, nil, fmt.Errorf("rule %d: invalid path_regex %q: %w", i+1, r.PathRegex, err)
+		}
+		if !re.MatchString(candidate) {
+			continue
+		}
+
+		recipients := make([]string, 0, len(r.Recipients))
+		for _, rec := range r.Recipients {
+			recipients = append(recipients, os.ExpandEnv(rec))
+		}
+		rule := r
+		return &rule, recipients, nil
+	}
+	return nil, nil, fmt.Errorf("no creation rule matches %q", candidate)
+}
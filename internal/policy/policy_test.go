@@ -0,0 +1,134 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "creation-rules.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadInvalidPathRegex(t *testing.T) {
+	path := writeConfig(t, `
+creation_rules:
+  - path_regex: "["
+    age: ["age1..."]
+`)
+	if _, err := Load(path); err == nil {
+		t.Fatal("Load accepted an invalid path_regex")
+	}
+}
+
+func TestMatchFirstRuleWins(t *testing.T) {
+	path := writeConfig(t, `
+creation_rules:
+  - path_regex: "\\.secret\\.yaml$"
+    age: ["age1first"]
+  - path_regex: "\\.yaml$"
+    age: ["age1second"]
+`)
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule, recipients, err := c.Match("config.secret.yaml", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 1 || recipients[0] != "age1first" {
+		t.Fatalf("expected the first matching rule to win, got %v from rule %+v", recipients, rule)
+	}
+}
+
+func TestMatchExpandsEnv(t *testing.T) {
+	t.Setenv("TEST_POLICY_RECIPIENT", "age1fromenv")
+	path := writeConfig(t, `
+creation_rules:
+  - path_regex: "\\.yaml$"
+    age: ["$TEST_POLICY_RECIPIENT"]
+`)
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, recipients, err := c.Match("config.yaml", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recipients) != 1 || recipients[0] != "age1fromenv" {
+		t.Fatalf("expected $VAR to expand to age1fromenv, got %v", recipients)
+	}
+}
+
+func TestMatchNoRuleMatches(t *testing.T) {
+	path := writeConfig(t, `
+creation_rules:
+  - path_regex: "\\.yaml$"
+    age: ["age1..."]
+`)
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Match("config.json", ""); err == nil {
+		t.Fatal("Match returned no error for a path with no matching rule")
+	}
+}
+
+func TestMatchPathOverride(t *testing.T) {
+	path := writeConfig(t, `
+creation_rules:
+  - path_regex: "\\.secret$"
+    age: ["age1..."]
+`)
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.Match("-", "config.secret"); err != nil {
+		t.Fatalf("pathOverride should have been matched instead of the literal path: %v", err)
+	}
+}
+
+func TestRuleArmorPointerDistinguishesUnset(t *testing.T) {
+	path := writeConfig(t, `
+creation_rules:
+  - path_regex: "\\.a$"
+    age: ["age1..."]
+    armor: false
+  - path_regex: "\\.b$"
+    age: ["age1..."]
+`)
+	c, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ruleA, _, err := c.Match("x.a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ruleA.Armor == nil || *ruleA.Armor != false {
+		t.Fatalf("expected rule with explicit \"armor: false\" to have a non-nil pointer, got %v", ruleA.Armor)
+	}
+	ruleB, _, err := c.Match("x.b", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ruleB.Armor != nil {
+		t.Fatalf("expected rule without an armor key to have a nil pointer, got %v", *ruleB.Armor)
+	}
+}
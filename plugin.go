@@ -0,0 +1,375 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// errNotPlugin is returned by the plugin parsers when the input string is
+// not shaped like a plugin recipient or identity, so callers can fall
+// through to the regular parsing paths.
+var errNotPlugin = errors.New("not a plugin string")
+
+// validPluginName matches the age-plugin naming convention, e.g. "yubikey"
+// or "age-plugin-foo-bar"'s "foo-bar". It rejects "/", "..", and any other
+// byte that could turn pluginBinaryName's output into something other than
+// a plain PATH-searched command name.
+var validPluginName = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// pluginRecipient is an age.Recipient that forwards wrapping to an external
+// "age-plugin-NAME" binary over the plugin stdio protocol, enabling
+// hardware-backed keys (YubiKey, TPM, SE) and cloud KMS integrations
+// without the core needing to know about them.
+type pluginRecipient struct {
+	name     string // plugin name, e.g. "yubikey"
+	encoding string // the full "age1name1..." recipient string
+	terminal pluginUI
+}
+
+// pluginIdentity is the identity-side counterpart of pluginRecipient,
+// constructed from an "AGE-PLUGIN-NAME-1..." identity string.
+type pluginIdentity struct {
+	name     string
+	encoding string
+	terminal pluginUI
+}
+
+// pluginUI lets a plugin process interact with the same terminal age is
+// attached to, so a hardware token can ask for a PIN or a touch
+// confirmation through the usual passphrase prompt.
+type pluginUI interface {
+	DisplayMessage(message string) error
+	RequestValue(prompt string, secret bool) (string, error)
+	Confirm(message, yes, no string) (bool, error)
+}
+
+// ttyPluginUI implements pluginUI on top of the CLI's existing
+// readPassphrase helper, so plugin prompts look identical to age's own
+// passphrase prompt.
+type ttyPluginUI struct{}
+
+func (ttyPluginUI) DisplayMessage(message string) error {
+	warningf("%s", message)
+	return nil
+}
+
+func (ttyPluginUI) RequestValue(prompt string, secret bool) (string, error) {
+	if !secret {
+		warningf("%s", prompt)
+		return "", nil
+	}
+	v, err := readPassphrase(prompt)
+	if err != nil {
+		return "", fmt.Errorf("could not read value: %v", err)
+	}
+	return string(v), nil
+}
+
+func (ttyPluginUI) Confirm(message, yes, no string) (bool, error) {
+	prompt := message + " [" + yes + "/" + no + "]"
+	v, err := readPassphrase(prompt)
+	if err != nil {
+		return false, fmt.Errorf("could not read confirmation: %v", err)
+	}
+	return strings.EqualFold(strings.TrimSpace(string(v)), yes), nil
+}
+
+// pluginNameFromRecipient extracts "name" out of an "age1name1..." string,
+// or returns errNotPlugin if s is a plain age1... or ssh-... recipient.
+func pluginNameFromRecipient(s string) (string, error) {
+	if !strings.HasPrefix(s, "age1") {
+		return "", errNotPlugin
+	}
+	rest := s[len("age1"):]
+	i := strings.Index(rest, "1")
+	if i <= 0 {
+		// No second separator, or nothing before it: this is a plain
+		// native X25519 recipient, not a plugin one.
+		return "", errNotPlugin
+	}
+	name := rest[:i]
+	if !validPluginName.MatchString(name) {
+		return "", fmt.Errorf("%q is not a valid plugin name", name)
+	}
+	return name, nil
+}
+
+// pluginNameFromIdentity extracts "NAME" out of an "AGE-PLUGIN-NAME-1..."
+// string, or returns errNotPlugin if s is a plain AGE-SECRET-KEY-1... line.
+func pluginNameFromIdentity(s string) (string, error) {
+	const prefix = "AGE-PLUGIN-"
+	if !strings.HasPrefix(s, prefix) {
+		return "", errNotPlugin
+	}
+	rest := s[len(prefix):]
+	i := strings.Index(rest, "-1")
+	if i <= 0 {
+		return "", errNotPlugin
+	}
+	name := strings.ToLower(rest[:i])
+	if !validPluginName.MatchString(name) {
+		return "", fmt.Errorf("%q is not a valid plugin name", name)
+	}
+	return name, nil
+}
+
+// parsePluginRecipient returns a pluginRecipient for a "age1name1..."
+// string, or errNotPlugin if s isn't plugin-shaped.
+func parsePluginRecipient(s string) (age.Recipient, error) {
+	name, err := pluginNameFromRecipient(s)
+	if err != nil {
+		return nil, err
+	}
+	return &pluginRecipient{name: name, encoding: s, terminal: ttyPluginUI{}}, nil
+}
+
+// parsePluginIdentity returns a pluginIdentity for an
+// "AGE-PLUGIN-NAME-1..." string, or errNotPlugin if s isn't plugin-shaped.
+func parsePluginIdentity(s string) (age.Identity, error) {
+	name, err := pluginNameFromIdentity(s)
+	if err != nil {
+		return nil, err
+	}
+	return &pluginIdentity{name: name, encoding: s, terminal: ttyPluginUI{}}, nil
+}
+
+// pluginBinaryName is the PATH-resolved name of the external plugin binary
+// that implements operations for the named plugin.
+func pluginBinaryName(name string) string {
+	return "age-plugin-" + name
+}
+
+// Wrap starts "age-plugin-NAME", asks it to wrap fileKey for the recipient
+// this value was parsed from, and returns the stanzas it produces. A
+// single plugin recipient can return more than one stanza, for example
+// when it fans out to several hardware slots.
+func (p *pluginRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	conn, err := startPlugin(p.name, "recipient-v1")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.writeStanza(&age.Stanza{Type: "add-recipient", Args: []string{p.encoding}}); err != nil {
+		return nil, err
+	}
+	if err := conn.writeStanza(&age.Stanza{Type: "wrap-file-key", Body: fileKey}); err != nil {
+		return nil, err
+	}
+	if err := conn.writeStanza(&age.Stanza{Type: "done"}); err != nil {
+		return nil, err
+	}
+
+	var stanzas []*age.Stanza
+	for {
+		s, err := conn.readStanza()
+		if err == io.EOF {
+			if len(stanzas) == 0 {
+				return nil, fmt.Errorf("%s: closed without producing a stanza", pluginBinaryName(p.name))
+			}
+			return stanzas, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", pluginBinaryName(p.name), err)
+		}
+		switch s.Type {
+		case "recipient-stanza":
+			if len(s.Args) < 1 {
+				return nil, fmt.Errorf("%s: malformed recipient-stanza", pluginBinaryName(p.name))
+			}
+			stanzas = append(stanzas, &age.Stanza{Type: s.Args[0], Args: s.Args[1:], Body: s.Body})
+		case "error":
+			return nil, pluginError(p.name, s)
+		default:
+			if err := conn.handlePassthrough(s, p.terminal); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// Unwrap starts "age-plugin-NAME", offers it the candidate stanzas, and
+// returns the unwrapped file key if the plugin owns one of them.
+func (p *pluginIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	conn, err := startPlugin(p.name, "identity-v1")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.writeStanza(&age.Stanza{Type: "add-identity", Args: []string{p.encoding}}); err != nil {
+		return nil, err
+	}
+	for _, s := range stanzas {
+		args := append([]string{s.Type}, s.Args...)
+		if err := conn.writeStanza(&age.Stanza{Type: "recipient-stanza", Args: append([]string{"0"}, args...), Body: s.Body}); err != nil {
+			return nil, err
+		}
+	}
+	if err := conn.writeStanza(&age.Stanza{Type: "done"}); err != nil {
+		return nil, err
+	}
+
+	for {
+		s, err := conn.readStanza()
+		if err == io.EOF {
+			// The plugin closed without claiming any of the candidate
+			// stanzas: none of them are ours, same as a native identity
+			// that doesn't match.
+			return nil, age.ErrIncorrectIdentity
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", pluginBinaryName(p.name), err)
+		}
+		switch s.Type {
+		case "file-key":
+			return s.Body, nil
+		case "error":
+			return nil, pluginError(p.name, s)
+		default:
+			if err := conn.handlePassthrough(s, p.terminal); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func pluginError(name string, s *age.Stanza) error {
+	msg := string(s.Body)
+	if msg == "" && len(s.Args) > 0 {
+		msg = strings.Join(s.Args, " ")
+	}
+	return fmt.Errorf("%s: %s", pluginBinaryName(name), msg)
+}
+
+// pluginConn is a running age-plugin-NAME process and the stanza-based
+// stdio protocol multiplexed over its stdin/stdout.
+type pluginConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func startPlugin(name, phase string) (*pluginConn, error) {
+	cmd := exec.Command(pluginBinaryName(name), "--age-plugin="+phase)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", pluginBinaryName(name), err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", pluginBinaryName(name), err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %v", pluginBinaryName(name), err)
+	}
+	return &pluginConn{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+func (c *pluginConn) Close() error {
+	c.stdin.Close()
+	return c.cmd.Wait()
+}
+
+// writeStanza frames a stanza the same way age itself does on the wire: a
+// "-> type args..." header line followed by the body base64-encoded and
+// wrapped at 64 columns, terminated by a short last line.
+func (c *pluginConn) writeStanza(s *age.Stanza) error {
+	line := "-> " + s.Type
+	if len(s.Args) > 0 {
+		line += " " + strings.Join(s.Args, " ")
+	}
+	if _, err := fmt.Fprintln(c.stdin, line); err != nil {
+		return err
+	}
+	enc := base64.RawStdEncoding.EncodeToString(s.Body)
+	for len(enc) >= 64 {
+		if _, err := fmt.Fprintln(c.stdin, enc[:64]); err != nil {
+			return err
+		}
+		enc = enc[64:]
+	}
+	if _, err := fmt.Fprintln(c.stdin, enc); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *pluginConn) readStanza() (*age.Stanza, error) {
+	head, err := c.stdout.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(strings.TrimPrefix(strings.TrimSuffix(head, "\n"), "-> "))
+	if len(fields) == 0 {
+		return nil, errors.New("malformed stanza header")
+	}
+	s := &age.Stanza{Type: fields[0], Args: fields[1:]}
+	var body []byte
+	for {
+		line, err := c.stdout.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		chunk, err := base64.RawStdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("malformed stanza body: %v", err)
+		}
+		body = append(body, chunk...)
+		if len(line) < 64 {
+			break
+		}
+	}
+	s.Body = body
+	return s, nil
+}
+
+// handlePassthrough answers the TTY passthrough stanzas a plugin can send
+// at any point in the protocol (msg, confirm, request-public,
+// request-secret), so hardware tokens can prompt for a PIN or a touch.
+func (c *pluginConn) handlePassthrough(s *age.Stanza, ui pluginUI) error {
+	switch s.Type {
+	case "msg":
+		return ui.DisplayMessage(string(s.Body))
+	case "confirm":
+		yes, no := "yes", "no"
+		if len(s.Args) > 0 {
+			yes = s.Args[0]
+		}
+		if len(s.Args) > 1 {
+			no = s.Args[1]
+		}
+		ok, err := ui.Confirm(string(s.Body), yes, no)
+		if err != nil {
+			return err
+		}
+		reply := "no"
+		if ok {
+			reply = "yes"
+		}
+		return c.writeStanza(&age.Stanza{Type: "ok", Args: []string{reply}})
+	case "request-public", "request-secret":
+		v, err := ui.RequestValue(string(s.Body), s.Type == "request-secret")
+		if err != nil {
+			return err
+		}
+		return c.writeStanza(&age.Stanza{Type: "ok", Body: []byte(v)})
+	default:
+		return fmt.Errorf("unexpected stanza %q from plugin", s.Type)
+	}
+}
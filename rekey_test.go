@@ -0,0 +1,117 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+func TestRekeyWriteArmorRoundTrip(t *testing.T) {
+	for _, withArmor := range []bool{false, true} {
+		id, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext := []byte("hello, age")
+
+		var ciphertext bytes.Buffer
+		if err := rekeyWrite(&ciphertext, []age.Recipient{id.Recipient()}, bytes.NewReader(plaintext), withArmor); err != nil {
+			t.Fatal(err)
+		}
+
+		var plain io.Reader
+		if withArmor {
+			plain, err = age.Decrypt(armor.NewReader(bytes.NewReader(ciphertext.Bytes())), id)
+		} else {
+			plain, err = age.Decrypt(bytes.NewReader(ciphertext.Bytes()), id)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("armor=%v: round trip mismatch: got %q, want %q", withArmor, got, plaintext)
+		}
+	}
+}
+
+func TestRekeyInplaceReplacesRecipients(t *testing.T) {
+	oldID, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newID, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret.age")
+	plaintext := []byte("rotate me")
+
+	var ciphertext bytes.Buffer
+	w, err := age.Encrypt(&ciphertext, oldID.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, ciphertext.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	idFile := filepath.Join(dir, "id.txt")
+	if err := os.WriteFile(idFile, []byte(oldID.String()+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	rekey([]string{idFile}, []string{newID.Recipient().String()}, nil, path, "", true, nil)
+
+	rekeyed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(rekeyed, ciphertext.Bytes()) {
+		t.Fatal("--inplace left the original ciphertext untouched")
+	}
+	if _, err := age.Decrypt(bytes.NewReader(rekeyed), oldID); err == nil {
+		t.Fatal("the old identity can still decrypt the rekeyed file")
+	}
+	r, err := age.Decrypt(bytes.NewReader(rekeyed), newID)
+	if err != nil {
+		t.Fatalf("the new identity can't decrypt the rekeyed file: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("rekeyed plaintext mismatch: got %q, want %q", got, plaintext)
+	}
+
+	if entries, err := os.ReadDir(dir); err == nil {
+		for _, e := range entries {
+			if e.Name() != "secret.age" && e.Name() != "id.txt" {
+				t.Fatalf("rekey left a stray temporary file behind: %s", e.Name())
+			}
+		}
+	}
+}
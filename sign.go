@@ -0,0 +1,219 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// age provides confidentiality but no sender authentication. signEncrypt
+// and verifyDecrypt close that gap for distribution scenarios, such as
+// encrypted release artifacts, where recipients want to verify who
+// produced a file and not just be able to decrypt it.
+const (
+	signerSecretKeyPrefix = "AGE-SIGN-SECRET-KEY-1"
+	// signerPublicKeyPrefix deliberately doesn't start with "age1": every
+	// "age1<name>1..." string is parsed as a plugin recipient for a plugin
+	// named <name> (see pluginNameFromRecipient), and a plugin named "sig"
+	// would make signer keys indistinguishable from plugin recipients.
+	signerPublicKeyPrefix = "agesig1"
+	signatureTrailerTag   = "age-signature-v1"
+)
+
+// parseSignerIdentity reads a single Ed25519 signing identity from path,
+// one "AGE-SIGN-SECRET-KEY-1<base64 seed>" line, alongside the usual
+// comment and blank line conventions of age identity files.
+func parseSignerIdentity(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.HasPrefix(line, signerSecretKeyPrefix) {
+			return nil, fmt.Errorf("%q is not a signing identity file", path)
+		}
+		seed, err := base64.RawStdEncoding.DecodeString(line[len(signerSecretKeyPrefix):])
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("malformed signing identity in %q", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("no signing identity found in %q", path)
+}
+
+// parseSignerRecipient parses an "agesig1<base64>" allowed-signer string,
+// the public half of a signing identity, into its Ed25519 public key.
+func parseSignerRecipient(s string) (ed25519.PublicKey, error) {
+	if !strings.HasPrefix(s, signerPublicKeyPrefix) {
+		return nil, fmt.Errorf("%q is not a signer public key", s)
+	}
+	pub, err := base64.RawStdEncoding.DecodeString(s[len(signerPublicKeyPrefix):])
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("malformed signer public key %q", s)
+	}
+	return ed25519.PublicKey(pub), nil
+}
+
+// signEncrypt encrypts in to out as usual and then signs a SHA-256
+// transcript hash of the resulting ciphertext with signer, storing the
+// signature either as a trailer appended to out or, if detachPath is
+// non-empty, as a separate file at detachPath.
+func signEncrypt(recipients []age.Recipient, signer ed25519.PrivateKey, in io.Reader, out io.Writer, withArmor bool, detachPath string) {
+	h := sha256.New()
+	encrypt(recipients, in, io.MultiWriter(out, h), withArmor)
+
+	trailer := signatureTrailer(signer, h.Sum(nil))
+	if detachPath != "" {
+		if err := os.WriteFile(detachPath, []byte(trailer), 0o644); err != nil {
+			errorf("failed to write detached signature %q: %v", detachPath, err)
+		}
+		return
+	}
+	if _, err := io.WriteString(out, trailer); err != nil {
+		errorf("%v", err)
+	}
+}
+
+// signatureTrailer signs sum, the SHA-256 digest of the ciphertext, and
+// formats the result as a signature trailer.
+func signatureTrailer(signer ed25519.PrivateKey, sum []byte) string {
+	sig := ed25519.Sign(signer, sum)
+	pub := signer.Public().(ed25519.PublicKey)
+	return fmt.Sprintf("-> %s %s%s\n%s\n", signatureTrailerTag, signerPublicKeyPrefix,
+		base64.RawStdEncoding.EncodeToString(pub), base64.RawStdEncoding.EncodeToString(sig))
+}
+
+// verifyDecrypt checks an attached (or, with detachPath set, detached)
+// signature trailer produced by signEncrypt against allowed, then
+// decrypts the remaining ciphertext with identities.
+func verifyDecrypt(identities []age.Identity, allowed []ed25519.PublicKey, in io.Reader, out io.Writer, detachPath string) {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		errorf("%v", err)
+	}
+
+	var trailer string
+	if detachPath != "" {
+		raw, err := os.ReadFile(detachPath)
+		if err != nil {
+			errorf("failed to read detached signature %q: %v", detachPath, err)
+		}
+		trailer = string(raw)
+	} else {
+		marker := []byte("-> " + signatureTrailerTag + " ")
+		idx := bytes.LastIndex(data, marker)
+		if idx < 0 {
+			errorf("no signature found in input; use --verify-detached for a detached signature")
+		}
+		trailer = string(data[idx:])
+		data = data[:idx]
+	}
+
+	pub, sig, err := parseSignatureTrailer(trailer)
+	if err != nil {
+		errorf("%v", err)
+	}
+	if !signerAllowed(pub, allowed) {
+		errorf("file was signed by %s%s, which is not an allowed signer",
+			signerPublicKeyPrefix, base64.RawStdEncoding.EncodeToString(pub))
+	}
+	sum := sha256.Sum256(data)
+	if !ed25519.Verify(pub, sum[:], sig) {
+		errorf("signature verification failed")
+	}
+
+	br := bufio.NewReader(bytes.NewReader(data))
+	var ciphertext io.Reader = br
+	if start, _ := br.Peek(len(armor.Header)); string(start) == armor.Header {
+		ciphertext = armor.NewReader(br)
+	}
+	r, err := age.Decrypt(ciphertext, identities...)
+	if err != nil {
+		errorf("%v", err)
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		errorf("%v", err)
+	}
+}
+
+func parseSignatureTrailer(trailer string) (ed25519.PublicKey, []byte, error) {
+	lines := strings.SplitN(strings.TrimRight(trailer, "\n"), "\n", 2)
+	if len(lines) != 2 {
+		return nil, nil, errors.New("malformed signature trailer")
+	}
+	fields := strings.Fields(lines[0])
+	if len(fields) != 3 || fields[0] != "->" || fields[1] != signatureTrailerTag {
+		return nil, nil, errors.New("malformed signature trailer header")
+	}
+	pub, err := parseSignerRecipient(fields[2])
+	if err != nil {
+		return nil, nil, err
+	}
+	sig, err := base64.RawStdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return nil, nil, errors.New("malformed signature")
+	}
+	return pub, sig, nil
+}
+
+func signerAllowed(pub ed25519.PublicKey, allowed []ed25519.PublicKey) bool {
+	for _, a := range allowed {
+		if a.Equal(pub) {
+			return true
+		}
+	}
+	return false
+}
+
+// encryptKeysSigned is encryptKeys' recipient-gathering loop, reused here
+// so --sign doesn't have to share encryptKeys' unrelated -i (symmetric
+// recipient) handling with the signing identity passed through -i.
+func encryptKeysSigned(keys, files []string, signer ed25519.PrivateKey, in io.Reader, out io.Writer, armor bool, detachPath string) {
+	var recipients []age.Recipient
+	for _, arg := range keys {
+		if r, err := parsePluginRecipient(arg); err != errNotPlugin {
+			if err != nil {
+				errorf("%v", err)
+			}
+			recipients = append(recipients, r)
+			continue
+		}
+		r, err := parseRecipient(arg)
+		if err != nil {
+			errorf("%v", err)
+		}
+		recipients = append(recipients, r)
+	}
+	for _, name := range files {
+		recs, err := parseRecipientsFile(name)
+		if err != nil {
+			errorf("failed to parse recipient file %q: %v", name, err)
+		}
+		recipients = append(recipients, recs...)
+	}
+	signEncrypt(recipients, signer, in, out, armor, detachPath)
+}
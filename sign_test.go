@@ -0,0 +1,41 @@
+// Copyright 2019 Google LLC
+//
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file or at
+// https://developers.google.com/open-source/licenses/bsd
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// TestSignArmorRoundTrip checks that a --sign --armor file can be read
+// back with --verify: the signature trailer must be stripped before the
+// armored ciphertext is handed to age.Decrypt, not after.
+func TestSignArmorRoundTrip(t *testing.T) {
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, signer, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plaintext := []byte("hello, age")
+	var ciphertext bytes.Buffer
+	signEncrypt([]age.Recipient{id.Recipient()}, signer, bytes.NewReader(plaintext), &ciphertext, true, "")
+
+	allowed := []ed25519.PublicKey{signer.Public().(ed25519.PublicKey)}
+	var plain bytes.Buffer
+	verifyDecrypt([]age.Identity{id}, allowed, bytes.NewReader(ciphertext.Bytes()), &plain, "")
+
+	if !bytes.Equal(plain.Bytes(), plaintext) {
+		t.Fatalf("round trip mismatch: got %q, want %q", plain.Bytes(), plaintext)
+	}
+}